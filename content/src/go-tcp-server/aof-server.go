@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is one value held by the Store, together with its optional
+// expiration. A zero ExpiresAt means the key never expires.
+type entry struct {
+	Value     string
+	ExpiresAt time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// Store is the key/value map behind the server, replacing the bare
+// map[string]string used by resp-server.go. It is safe for concurrent use
+// since handleConnection is spawned per connection, and it runs a
+// background goroutine that actively evicts expired keys so they don't
+// linger in memory until someone happens to access them.
+type Store struct {
+	mu   sync.RWMutex
+	data map[string]entry
+	now  func() time.Time // injectable for tests
+}
+
+func NewStore() *Store {
+	return &Store{
+		data: make(map[string]entry),
+		now:  time.Now,
+	}
+}
+
+func (s *Store) Get(key string) (string, bool) {
+	s.mu.RLock()
+	e, ok := s.data[key]
+	s.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	if e.expired(s.now()) {
+		s.Del(key)
+		return "", false
+	}
+
+	return e.Value, true
+}
+
+func (s *Store) Set(key, value string) {
+	s.mu.Lock()
+	s.data[key] = entry{Value: value}
+	s.mu.Unlock()
+}
+
+// SetExpire sets key to value with an expiration ttl from now. A zero ttl
+// means no expiration.
+func (s *Store) SetExpire(key, value string, ttl time.Duration) {
+	s.mu.Lock()
+	e := entry{Value: value}
+	if ttl > 0 {
+		e.ExpiresAt = s.now().Add(ttl)
+	}
+	s.data[key] = e
+	s.mu.Unlock()
+}
+
+func (s *Store) Exists(key string) bool {
+	_, ok := s.Get(key)
+	return ok
+}
+
+func (s *Store) Del(key string) bool {
+	s.mu.Lock()
+	_, ok := s.data[key]
+	delete(s.data, key)
+	s.mu.Unlock()
+	return ok
+}
+
+func (s *Store) Incr(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.data[key]
+	if ok && e.expired(s.now()) {
+		ok = false
+	}
+
+	intValue := 0
+	if ok {
+		parsed, err := strconv.Atoi(e.Value)
+		if err != nil {
+			return 0, fmt.Errorf("ERR value is not an integer or out of range")
+		}
+		intValue = parsed
+	}
+
+	intValue++
+	e.Value = strconv.Itoa(intValue)
+	s.data[key] = e
+	return intValue, nil
+}
+
+// Expire sets key to expire after ttl. It returns false if the key does
+// not exist.
+func (s *Store) Expire(key string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.data[key]
+	if !ok || e.expired(s.now()) {
+		return false
+	}
+
+	e.ExpiresAt = s.now().Add(ttl)
+	s.data[key] = e
+	return true
+}
+
+// Persist removes key's expiration, if any. It returns true only when an
+// expiration was actually cleared.
+func (s *Store) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.data[key]
+	if !ok || e.expired(s.now()) || e.ExpiresAt.IsZero() {
+		return false
+	}
+
+	e.ExpiresAt = time.Time{}
+	s.data[key] = e
+	return true
+}
+
+// TTL returns the remaining time to live for key in seconds, -1 if key
+// exists but has no expiration, or -2 if key does not exist.
+func (s *Store) TTL(key string) int {
+	s.mu.RLock()
+	e, ok := s.data[key]
+	s.mu.RUnlock()
+
+	if !ok || e.expired(s.now()) {
+		return -2
+	}
+	if e.ExpiresAt.IsZero() {
+		return -1
+	}
+
+	return int(e.ExpiresAt.Sub(s.now()).Round(time.Second) / time.Second)
+}
+
+// runActiveExpirationCycle samples up to sampleSize keys, deletes the ones
+// that have expired, and reports how many were sampled and expired. This
+// mirrors the sampled probabilistic expiry used by production key-value
+// stores: the caller repeats the cycle while more than 25% of the sample
+// was expired, since that suggests there are more stale keys left.
+func (s *Store) runActiveExpirationCycle(sampleSize int) (sampled, expired int) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.data) == 0 {
+		return 0, 0
+	}
+
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	if len(keys) > sampleSize {
+		keys = keys[:sampleSize]
+	}
+
+	for _, k := range keys {
+		sampled++
+		if s.data[k].expired(now) {
+			delete(s.data, k)
+			expired++
+		}
+	}
+
+	return sampled, expired
+}
+
+// startActiveExpiration runs runActiveExpirationCycle every interval until
+// done is closed, re-running within the same tick whenever more than 25%
+// of the sample came back expired.
+func (s *Store) startActiveExpiration(done <-chan struct{}, interval time.Duration, sampleSize int) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for {
+					sampled, expired := s.runActiveExpirationCycle(sampleSize)
+					if sampled == 0 || float64(expired)/float64(sampled) <= 0.25 {
+						break
+					}
+				}
+			}
+		}
+	}()
+}
+
+// command is a single parsed client request: a name and the arguments that
+// follow it.
+type command struct {
+	name string
+	args []string
+}
+
+// writeCommands are the commands that mutate the store and therefore need
+// to be durably logged to the append-only file.
+var writeCommands = map[string]bool{
+	"SET":     true,
+	"DEL":     true,
+	"INCR":    true,
+	"EXPIRE":  true,
+	"PEXPIRE": true,
+	"PERSIST": true,
+}
+
+// encodeCommand serializes cmd back into the RESP array-of-bulk-strings
+// form it was read as, so the AOF and the wire protocol share one
+// representation.
+func encodeCommand(cmd command) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(cmd.args)+1)
+	fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(cmd.name), cmd.name)
+	for _, arg := range cmd.args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// AOFSyncPolicy controls how often the append-only file is fsynced.
+type AOFSyncPolicy string
+
+const (
+	AOFSyncAlways   AOFSyncPolicy = "always"
+	AOFSyncEverySec AOFSyncPolicy = "everysec"
+	AOFSyncNo       AOFSyncPolicy = "no"
+)
+
+// AOF is the append-only log: every write command is serialized in RESP
+// array form and appended to file, fsynced according to policy.
+type AOF struct {
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	policy AOFSyncPolicy
+}
+
+// OpenAOF opens (creating if necessary) the append-only file at path and,
+// for the everysec policy, starts the background flusher goroutine.
+func OpenAOF(path string, policy AOFSyncPolicy) (*AOF, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AOF{file: f, path: path, policy: policy}
+	if policy == AOFSyncEverySec {
+		go a.flushEverySecond()
+	}
+
+	return a, nil
+}
+
+func (a *AOF) flushEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.mu.Lock()
+		a.file.Sync()
+		a.mu.Unlock()
+	}
+}
+
+// Append logs cmd. Under the always policy it fsyncs before returning;
+// everysec relies on flushEverySecond and no never fsyncs explicitly.
+func (a *AOF) Append(cmd command) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.file.WriteString(encodeCommand(cmd)); err != nil {
+		return err
+	}
+
+	if a.policy == AOFSyncAlways {
+		return a.file.Sync()
+	}
+	return nil
+}
+
+// Rewrite snapshots store into a fresh, compacted AOF and atomically
+// renames it over the current file, implementing BGREWRITEAOF.
+func (a *AOF) Rewrite(store *Store) error {
+	tmpPath := a.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	store.mu.RLock()
+	now := store.now()
+	for key, e := range store.data {
+		if e.expired(now) {
+			continue
+		}
+		tmp.WriteString(encodeCommand(command{name: "SET", args: []string{key, e.Value}}))
+		if !e.ExpiresAt.IsZero() {
+			ms := strconv.FormatInt(e.ExpiresAt.Sub(now).Milliseconds(), 10)
+			tmp.WriteString(encodeCommand(command{name: "PEXPIRE", args: []string{key, ms}}))
+		}
+	}
+	store.mu.RUnlock()
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.file.Close()
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return err
+	}
+
+	a.file, err = os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	return err
+}
+
+// replayAOF replays every command logged at path through the same
+// dispatcher live connections use, so loading on startup and serving
+// requests share one code path. A missing file means a fresh store.
+func replayAOF(path string, store *Store) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	sink := bufio.NewWriter(io.Discard)
+	for {
+		cmd, err := readCommand(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A process killed mid-write/mid-fsync leaves a truncated
+			// trailing command; ignore it rather than refusing to start,
+			// the same way real Redis truncates a torn record on replay.
+			fmt.Println("warning: truncating incomplete trailing command in append-only file")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		runCommand(store, sink, cmd)
+	}
+}
+
+// readCommand reads one request from r. It accepts RESP arrays of bulk
+// strings, the format redis-cli and loader tools speak, as well as the
+// plain space-separated inline commands a telnet client would send.
+func readCommand(r *bufio.Reader) (command, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return command{}, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "*") {
+		return readArrayCommand(r, line)
+	}
+
+	return readInlineCommand(line)
+}
+
+func readInlineCommand(line string) (command, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return command{}, fmt.Errorf("ERR empty command")
+	}
+
+	return command{name: strings.ToUpper(parts[0]), args: parts[1:]}, nil
+}
+
+func readArrayCommand(r *bufio.Reader, firstLine string) (command, error) {
+	count, err := strconv.Atoi(firstLine[1:])
+	if err != nil || count <= 0 {
+		return command{}, fmt.Errorf("ERR Protocol error: invalid multibulk length")
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		arg, err := readBulkString(r)
+		if err != nil {
+			return command{}, err
+		}
+		args = append(args, arg)
+	}
+
+	return command{name: strings.ToUpper(args[0]), args: args[1:]}, nil
+}
+
+// maxBulkLen caps the length a client (or a replayed AOF/dump file) can
+// claim for a single bulk string, mirroring real Redis's 512MB proto-max-
+// bulk-len so a bogus length can't force an arbitrarily large allocation.
+const maxBulkLen = 512 * 1024 * 1024
+
+// readBulkString reads a single `$len\r\n<bytes>\r\n` frame. It is
+// length-prefixed rather than line based so binary-safe values, including
+// ones containing '\n', survive the round trip.
+func readBulkString(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if !strings.HasPrefix(line, "$") {
+		return "", fmt.Errorf("ERR Protocol error: expected '$', got '%s'", line)
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return "", fmt.Errorf("ERR Protocol error: invalid bulk length")
+	}
+	if length > maxBulkLen {
+		return "", fmt.Errorf("ERR Protocol error: invalid bulk length")
+	}
+
+	buf := make([]byte, length+2) // +2 for the trailing \r\n
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf[:length]), nil
+}
+
+func writeSimpleString(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func writeInteger(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func writeBulkString(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeNullBulkString(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+// handler implements one command. It writes the reply to w and returns
+// false when the connection should be closed after it runs.
+type handler func(s *Store, w *bufio.Writer, args []string) bool
+
+var handlers = map[string]handler{
+	"STOP":         handleQuit,
+	"QUIT":         handleQuit,
+	"GET":          handleGet,
+	"SET":          handleSet,
+	"INCR":         handleIncr,
+	"DEL":          handleDel,
+	"EXPIRE":       handleExpire,
+	"PEXPIRE":      handlePExpire,
+	"TTL":          handleTTL,
+	"PERSIST":      handlePersist,
+	"ECHO":         handleEcho,
+	"BGREWRITEAOF": handleBgRewriteAOF,
+}
+
+// aof is the append-only log used to persist write commands. It is nil
+// when the server was started without -appendonly.
+var aof *AOF
+
+func handleQuit(s *Store, w *bufio.Writer, args []string) bool {
+	return false
+}
+
+func handleGet(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'get' command")
+		return true
+	}
+
+	value, ok := s.Get(args[0])
+	if !ok {
+		writeNullBulkString(w)
+		return true
+	}
+	writeBulkString(w, value)
+	return true
+}
+
+// handleSet implements SET key value [EX seconds|PX ms] [NX|XX].
+func handleSet(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) < 2 {
+		writeError(w, "ERR wrong number of arguments for 'set' command")
+		return true
+	}
+
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				writeError(w, "ERR syntax error")
+				return true
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				writeError(w, "ERR value is not an integer or out of range")
+				return true
+			}
+			if strings.ToUpper(args[i]) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			writeError(w, "ERR syntax error")
+			return true
+		}
+	}
+
+	exists := s.Exists(key)
+	if nx && exists {
+		writeNullBulkString(w)
+		return true
+	}
+	if xx && !exists {
+		writeNullBulkString(w)
+		return true
+	}
+
+	s.SetExpire(key, value, ttl)
+	writeSimpleString(w, "OK")
+	return true
+}
+
+func handleIncr(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'incr' command")
+		return true
+	}
+
+	n, err := s.Incr(args[0])
+	if err != nil {
+		writeError(w, err.Error())
+		return true
+	}
+	writeInteger(w, n)
+	return true
+}
+
+func handleDel(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'del' command")
+		return true
+	}
+
+	if s.Del(args[0]) {
+		writeInteger(w, 1)
+	} else {
+		writeInteger(w, 0)
+	}
+	return true
+}
+
+func handleExpire(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 2 {
+		writeError(w, "ERR wrong number of arguments for 'expire' command")
+		return true
+	}
+
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil {
+		writeError(w, "ERR value is not an integer or out of range")
+		return true
+	}
+
+	if s.Expire(args[0], time.Duration(seconds)*time.Second) {
+		writeInteger(w, 1)
+	} else {
+		writeInteger(w, 0)
+	}
+	return true
+}
+
+func handlePExpire(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 2 {
+		writeError(w, "ERR wrong number of arguments for 'pexpire' command")
+		return true
+	}
+
+	millis, err := strconv.Atoi(args[1])
+	if err != nil {
+		writeError(w, "ERR value is not an integer or out of range")
+		return true
+	}
+
+	if s.Expire(args[0], time.Duration(millis)*time.Millisecond) {
+		writeInteger(w, 1)
+	} else {
+		writeInteger(w, 0)
+	}
+	return true
+}
+
+func handleTTL(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'ttl' command")
+		return true
+	}
+
+	writeInteger(w, s.TTL(args[0]))
+	return true
+}
+
+func handlePersist(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'persist' command")
+		return true
+	}
+
+	if s.Persist(args[0]) {
+		writeInteger(w, 1)
+	} else {
+		writeInteger(w, 0)
+	}
+	return true
+}
+
+func handleEcho(s *Store, w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'echo' command")
+		return true
+	}
+
+	writeBulkString(w, args[0])
+	return true
+}
+
+func handleBgRewriteAOF(s *Store, w *bufio.Writer, args []string) bool {
+	if aof == nil {
+		writeError(w, "ERR appendonly is disabled")
+		return true
+	}
+
+	if err := aof.Rewrite(s); err != nil {
+		writeError(w, "ERR "+err.Error())
+		return true
+	}
+
+	writeSimpleString(w, "Background append only file rewriting started")
+	return true
+}
+
+func handleConnection(store *Store, client net.Conn) {
+	fmt.Printf("Serving %s\n", client.RemoteAddr().String())
+
+	reader := bufio.NewReader(client)
+	writer := bufio.NewWriter(client)
+
+	for {
+		cmd, err := readCommand(reader)
+		if err != nil {
+			fmt.Println("error reading:", err)
+			break
+		}
+
+		if !runCommand(store, writer, cmd) {
+			break
+		}
+
+		writer.Flush()
+	}
+
+	fmt.Println("Closing client")
+	client.Close()
+}
+
+// runCommand dispatches cmd to its handler and writes the reply to w. It
+// returns false when the connection should be closed.
+func runCommand(s *Store, w *bufio.Writer, cmd command) bool {
+	h, ok := handlers[cmd.name]
+	if !ok {
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", cmd.name))
+		return true
+	}
+
+	more := h(s, w, cmd.args)
+
+	if aof != nil && writeCommands[cmd.name] {
+		if err := aof.Append(cmd); err != nil {
+			fmt.Println("error appending to AOF:", err)
+		}
+	}
+
+	return more
+}
+
+const activeExpirationInterval = 100 * time.Millisecond
+const activeExpirationSampleSize = 20
+
+func main() {
+	appendonlyPath := flag.String("appendonly", "", "path to the append-only file; empty disables persistence")
+	appendfsync := flag.String("appendfsync", string(AOFSyncNo), "fsync policy: always, everysec, or no")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Println("Please provide a port number!")
+		return
+	}
+
+	store := NewStore()
+
+	if *appendonlyPath != "" {
+		// Replay before the live append handle exists: runCommand only
+		// appends to the AOF when the package-level aof is non-nil, so
+		// replaying first keeps it nil and stops replayed writes from
+		// being re-logged onto the file they were just read from.
+		if err := replayAOF(*appendonlyPath, store); err != nil {
+			fmt.Println("error replaying append-only file:", err)
+			return
+		}
+
+		var err error
+		aof, err = OpenAOF(*appendonlyPath, AOFSyncPolicy(*appendfsync))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	PORT := ":" + args[0]
+	server, err := net.Listen("tcp4", PORT)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer server.Close()
+
+	done := make(chan struct{})
+	store.startActiveExpiration(done, activeExpirationInterval, activeExpirationSampleSize)
+	defer close(done)
+
+	for {
+		client, err := server.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go handleConnection(store, client)
+	}
+}
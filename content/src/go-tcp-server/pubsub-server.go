@@ -0,0 +1,1346 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// entry is one value held by the Store, together with its optional
+// expiration. A zero ExpiresAt means the key never expires.
+type entry struct {
+	Value     string
+	ExpiresAt time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// Store is the key/value map behind the server, replacing the bare
+// map[string]string used by resp-server.go. It is safe for concurrent use
+// since handleConnection is spawned per connection, and it runs a
+// background goroutine that actively evicts expired keys so they don't
+// linger in memory until someone happens to access them.
+type Store struct {
+	mu   sync.RWMutex
+	data map[string]entry
+	now  func() time.Time // injectable for tests
+}
+
+func NewStore() *Store {
+	return &Store{
+		data: make(map[string]entry),
+		now:  time.Now,
+	}
+}
+
+func (s *Store) Get(key string) (string, bool) {
+	s.mu.RLock()
+	e, ok := s.data[key]
+	s.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	if e.expired(s.now()) {
+		s.Del(key)
+		return "", false
+	}
+
+	return e.Value, true
+}
+
+func (s *Store) Set(key, value string) {
+	s.mu.Lock()
+	s.data[key] = entry{Value: value}
+	s.mu.Unlock()
+}
+
+// SetExpire sets key to value with an expiration ttl from now. A zero ttl
+// means no expiration.
+func (s *Store) SetExpire(key, value string, ttl time.Duration) {
+	s.mu.Lock()
+	e := entry{Value: value}
+	if ttl > 0 {
+		e.ExpiresAt = s.now().Add(ttl)
+	}
+	s.data[key] = e
+	s.mu.Unlock()
+}
+
+func (s *Store) Exists(key string) bool {
+	_, ok := s.Get(key)
+	return ok
+}
+
+func (s *Store) Del(key string) bool {
+	s.mu.Lock()
+	_, ok := s.data[key]
+	delete(s.data, key)
+	s.mu.Unlock()
+	return ok
+}
+
+func (s *Store) Incr(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.data[key]
+	if ok && e.expired(s.now()) {
+		ok = false
+	}
+
+	intValue := 0
+	if ok {
+		parsed, err := strconv.Atoi(e.Value)
+		if err != nil {
+			return 0, fmt.Errorf("ERR value is not an integer or out of range")
+		}
+		intValue = parsed
+	}
+
+	intValue++
+	e.Value = strconv.Itoa(intValue)
+	s.data[key] = e
+	return intValue, nil
+}
+
+// Expire sets key to expire after ttl. It returns false if the key does
+// not exist.
+func (s *Store) Expire(key string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.data[key]
+	if !ok || e.expired(s.now()) {
+		return false
+	}
+
+	e.ExpiresAt = s.now().Add(ttl)
+	s.data[key] = e
+	return true
+}
+
+// Persist removes key's expiration, if any. It returns true only when an
+// expiration was actually cleared.
+func (s *Store) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.data[key]
+	if !ok || e.expired(s.now()) || e.ExpiresAt.IsZero() {
+		return false
+	}
+
+	e.ExpiresAt = time.Time{}
+	s.data[key] = e
+	return true
+}
+
+// TTL returns the remaining time to live for key in seconds, -1 if key
+// exists but has no expiration, or -2 if key does not exist.
+func (s *Store) TTL(key string) int {
+	s.mu.RLock()
+	e, ok := s.data[key]
+	s.mu.RUnlock()
+
+	if !ok || e.expired(s.now()) {
+		return -2
+	}
+	if e.ExpiresAt.IsZero() {
+		return -1
+	}
+
+	return int(e.ExpiresAt.Sub(s.now()).Round(time.Second) / time.Second)
+}
+
+// runActiveExpirationCycle samples up to sampleSize keys, deletes the ones
+// that have expired, and reports how many were sampled and expired. This
+// mirrors the sampled probabilistic expiry used by production key-value
+// stores: the caller repeats the cycle while more than 25% of the sample
+// was expired, since that suggests there are more stale keys left.
+func (s *Store) runActiveExpirationCycle(sampleSize int) (sampled, expired int) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.data) == 0 {
+		return 0, 0
+	}
+
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	if len(keys) > sampleSize {
+		keys = keys[:sampleSize]
+	}
+
+	for _, k := range keys {
+		sampled++
+		if s.data[k].expired(now) {
+			delete(s.data, k)
+			expired++
+		}
+	}
+
+	return sampled, expired
+}
+
+// startActiveExpiration runs runActiveExpirationCycle every interval until
+// done is closed, re-running within the same tick whenever more than 25%
+// of the sample came back expired.
+func (s *Store) startActiveExpiration(done <-chan struct{}, interval time.Duration, sampleSize int) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for {
+					sampled, expired := s.runActiveExpirationCycle(sampleSize)
+					if sampled == 0 || float64(expired)/float64(sampled) <= 0.25 {
+						break
+					}
+				}
+			}
+		}
+	}()
+}
+
+// command is a single parsed client request: a name and the arguments that
+// follow it.
+type command struct {
+	name string
+	args []string
+}
+
+// writeCommands are the commands that mutate the store and therefore need
+// to be durably logged to the append-only file.
+var writeCommands = map[string]bool{
+	"SET":     true,
+	"DEL":     true,
+	"INCR":    true,
+	"EXPIRE":  true,
+	"PEXPIRE": true,
+	"PERSIST": true,
+}
+
+// encodeCommand serializes cmd back into the RESP array-of-bulk-strings
+// form it was read as, so the AOF and the wire protocol share one
+// representation.
+func encodeCommand(cmd command) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(cmd.args)+1)
+	fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(cmd.name), cmd.name)
+	for _, arg := range cmd.args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// encodeMessage builds a RESP array of bulk strings, the form used for
+// pub/sub deliveries (message/pmessage) and subscribe/unsubscribe acks.
+func encodeMessage(parts ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(parts))
+	for _, p := range parts {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(p), p)
+	}
+	return b.String()
+}
+
+// AOFSyncPolicy controls how often the append-only file is fsynced.
+type AOFSyncPolicy string
+
+const (
+	AOFSyncAlways   AOFSyncPolicy = "always"
+	AOFSyncEverySec AOFSyncPolicy = "everysec"
+	AOFSyncNo       AOFSyncPolicy = "no"
+)
+
+// AOF is the append-only log: every write command is serialized in RESP
+// array form and appended to file, fsynced according to policy.
+type AOF struct {
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	policy AOFSyncPolicy
+}
+
+// OpenAOF opens (creating if necessary) the append-only file at path and,
+// for the everysec policy, starts the background flusher goroutine.
+func OpenAOF(path string, policy AOFSyncPolicy) (*AOF, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AOF{file: f, path: path, policy: policy}
+	if policy == AOFSyncEverySec {
+		go a.flushEverySecond()
+	}
+
+	return a, nil
+}
+
+func (a *AOF) flushEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.mu.Lock()
+		a.file.Sync()
+		a.mu.Unlock()
+	}
+}
+
+// Append logs cmd. Under the always policy it fsyncs before returning;
+// everysec relies on flushEverySecond and no never fsyncs explicitly.
+func (a *AOF) Append(cmd command) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.file.WriteString(encodeCommand(cmd)); err != nil {
+		return err
+	}
+
+	if a.policy == AOFSyncAlways {
+		return a.file.Sync()
+	}
+	return nil
+}
+
+// Rewrite snapshots store into a fresh, compacted AOF and atomically
+// renames it over the current file, implementing BGREWRITEAOF.
+func (a *AOF) Rewrite(store *Store) error {
+	tmpPath := a.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	store.mu.RLock()
+	now := store.now()
+	for key, e := range store.data {
+		if e.expired(now) {
+			continue
+		}
+		tmp.WriteString(encodeCommand(command{name: "SET", args: []string{key, e.Value}}))
+		if !e.ExpiresAt.IsZero() {
+			ms := strconv.FormatInt(e.ExpiresAt.Sub(now).Milliseconds(), 10)
+			tmp.WriteString(encodeCommand(command{name: "PEXPIRE", args: []string{key, ms}}))
+		}
+	}
+	store.mu.RUnlock()
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.file.Close()
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return err
+	}
+
+	a.file, err = os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	return err
+}
+
+// replayAOF replays every command logged at path through the same
+// dispatcher live connections use, so loading on startup and serving
+// requests share one code path. A missing file means a fresh store.
+func replayAOF(path string, store *Store) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	replaySrv := &Server{store: store}
+	replayClient := &client{id: "replay", outbox: make(chan []byte, 1)}
+	for {
+		cmd, err := readCommand(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A process killed mid-write/mid-fsync leaves a truncated
+			// trailing command; ignore it rather than refusing to start,
+			// the same way real Redis truncates a torn record on replay.
+			fmt.Println("warning: truncating incomplete trailing command in append-only file")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		runCommand(replaySrv, replayClient, cmd)
+	}
+}
+
+// readCommand reads one request from r. It accepts RESP arrays of bulk
+// strings, the format redis-cli and loader tools speak, as well as the
+// plain space-separated inline commands a telnet client would send.
+func readCommand(r *bufio.Reader) (command, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return command{}, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "*") {
+		return readArrayCommand(r, line)
+	}
+
+	return readInlineCommand(line)
+}
+
+func readInlineCommand(line string) (command, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return command{}, fmt.Errorf("ERR empty command")
+	}
+
+	return command{name: strings.ToUpper(parts[0]), args: parts[1:]}, nil
+}
+
+func readArrayCommand(r *bufio.Reader, firstLine string) (command, error) {
+	count, err := strconv.Atoi(firstLine[1:])
+	if err != nil || count <= 0 {
+		return command{}, fmt.Errorf("ERR Protocol error: invalid multibulk length")
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		arg, err := readBulkString(r)
+		if err != nil {
+			return command{}, err
+		}
+		args = append(args, arg)
+	}
+
+	return command{name: strings.ToUpper(args[0]), args: args[1:]}, nil
+}
+
+// maxBulkLen caps the length a client (or a replayed AOF/dump file) can
+// claim for a single bulk string, mirroring real Redis's 512MB proto-max-
+// bulk-len so a bogus length can't force an arbitrarily large allocation.
+const maxBulkLen = 512 * 1024 * 1024
+
+// readBulkString reads a single `$len\r\n<bytes>\r\n` frame. It is
+// length-prefixed rather than line based so binary-safe values, including
+// ones containing '\n', survive the round trip.
+func readBulkString(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if !strings.HasPrefix(line, "$") {
+		return "", fmt.Errorf("ERR Protocol error: expected '$', got '%s'", line)
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return "", fmt.Errorf("ERR Protocol error: invalid bulk length")
+	}
+	if length > maxBulkLen {
+		return "", fmt.Errorf("ERR Protocol error: invalid bulk length")
+	}
+
+	buf := make([]byte, length+2) // +2 for the trailing \r\n
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf[:length]), nil
+}
+
+func simpleStringReply(s string) string {
+	return "+" + s + "\r\n"
+}
+
+func errorReply(s string) string {
+	return "-" + s + "\r\n"
+}
+
+func integerReply(n int) string {
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+func bulkStringReply(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func nullBulkStringReply() string {
+	return "$-1\r\n"
+}
+
+// outboxSize bounds how many pending replies a client can fall behind by
+// before it is considered a slow subscriber and dropped.
+const outboxSize = 1024
+
+// client is the per-connection state tracked by a Server. Every reply,
+// whether it is this connection's own command reply or a message pushed
+// in from a PUBLISH on another connection, is funneled through outbox and
+// drained by a single writer goroutine, so nothing ever writes to conn
+// from two goroutines at once.
+type client struct {
+	id     string
+	conn   net.Conn
+	outbox chan []byte
+
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func newClient(id string, conn net.Conn) *client {
+	c := &client{
+		id:       id,
+		conn:     conn,
+		outbox:   make(chan []byte, outboxSize),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *client) writeLoop() {
+	for msg := range c.outbox {
+		if _, err := c.conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// send enqueues msg without blocking. It returns false if the client's
+// outbox is full, meaning the client is too slow to keep up.
+func (c *client) send(msg string) bool {
+	select {
+	case c.outbox <- []byte(msg):
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *client) subscribed() bool {
+	return c.subscriptionCount() > 0
+}
+
+// PubSub tracks channel and pattern subscriptions across all connections.
+type PubSub struct {
+	mu       sync.Mutex
+	channels map[string]map[*client]struct{}
+	patterns map[string]map[*client]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*client]struct{}),
+		patterns: make(map[string]map[*client]struct{}),
+	}
+}
+
+func (ps *PubSub) Subscribe(channel string, c *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.channels[channel] == nil {
+		ps.channels[channel] = make(map[*client]struct{})
+	}
+	ps.channels[channel][c] = struct{}{}
+}
+
+func (ps *PubSub) Unsubscribe(channel string, c *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.channels[channel], c)
+	if len(ps.channels[channel]) == 0 {
+		delete(ps.channels, channel)
+	}
+}
+
+func (ps *PubSub) PSubscribe(pattern string, c *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.patterns[pattern] == nil {
+		ps.patterns[pattern] = make(map[*client]struct{})
+	}
+	ps.patterns[pattern][c] = struct{}{}
+}
+
+func (ps *PubSub) PUnsubscribe(pattern string, c *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.patterns[pattern], c)
+	if len(ps.patterns[pattern]) == 0 {
+		delete(ps.patterns, pattern)
+	}
+}
+
+// UnsubscribeAll removes c from every channel and pattern it is on,
+// called when its connection closes.
+func (ps *PubSub) UnsubscribeAll(c *client) {
+	for channel := range c.channels {
+		ps.Unsubscribe(channel, c)
+	}
+	for pattern := range c.patterns {
+		ps.PUnsubscribe(pattern, c)
+	}
+}
+
+// Publish delivers payload to every subscriber of channel and every
+// subscriber whose pattern matches it, returning how many received it. A
+// subscriber whose outbox is full is dropped rather than allowed to stall
+// the publisher.
+func (ps *PubSub) Publish(channel, payload string) int {
+	ps.mu.Lock()
+	var directSubs []*client
+	for c := range ps.channels[channel] {
+		directSubs = append(directSubs, c)
+	}
+	type patternGroup struct {
+		pattern string
+		clients []*client
+	}
+	var candidates []patternGroup
+	for pattern, subs := range ps.patterns {
+		var clients []*client
+		for c := range subs {
+			clients = append(clients, c)
+		}
+		candidates = append(candidates, patternGroup{pattern, clients})
+	}
+	ps.mu.Unlock()
+
+	count := 0
+	message := encodeMessage("message", channel, payload)
+	for _, c := range directSubs {
+		if c.send(message) {
+			count++
+		} else {
+			dropSlowSubscriber(c)
+		}
+	}
+
+	// globMatch runs outside ps.mu: it's O(len(pattern)*len(channel)) per
+	// candidate, and holding the lock across it would let one subscriber's
+	// pattern stall every other connection's SUBSCRIBE/PUBLISH.
+	for _, group := range candidates {
+		if !globMatch(group.pattern, channel) {
+			continue
+		}
+		pmessage := encodeMessage("pmessage", group.pattern, channel, payload)
+		for _, c := range group.clients {
+			if c.send(pmessage) {
+				count++
+			} else {
+				dropSlowSubscriber(c)
+			}
+		}
+	}
+
+	return count
+}
+
+// dropSlowSubscriber disconnects a client whose outbox filled up. The
+// error reply is queued on outbox with a non-blocking send, best effort,
+// rather than written directly to conn: the dedicated writeLoop goroutine
+// may itself be stalled mid-Write on that same conn, and conn must never
+// be written from two goroutines at once. conn.Close() is safe to call
+// concurrently with that in-flight Write, so it unblocks writeLoop either
+// way.
+func dropSlowSubscriber(c *client) {
+	select {
+	case c.outbox <- []byte(errorReply("ERR slow subscriber, dropped")):
+	default:
+	}
+	c.conn.Close()
+}
+
+// globToken is one parsed unit of a PSUBSCRIBE pattern: a literal byte,
+// '?' (any single byte), a '[...]' character class, or '*' (any run of
+// bytes, including none).
+type globToken struct {
+	star  bool
+	match func(byte) bool
+}
+
+// parseGlobPattern breaks pattern into tokens, collapsing consecutive '*'
+// into one, so globMatch never has to re-scan the raw pattern text.
+func parseGlobPattern(pattern string) []globToken {
+	var tokens []globToken
+	for i := 0; i < len(pattern); {
+		switch pattern[i] {
+		case '*':
+			if len(tokens) == 0 || !tokens[len(tokens)-1].star {
+				tokens = append(tokens, globToken{star: true})
+			}
+			i++
+		case '?':
+			tokens = append(tokens, globToken{match: func(byte) bool { return true }})
+			i++
+		case '[':
+			closing := strings.IndexByte(pattern[i+1:], ']')
+			if closing < 0 {
+				tokens = append(tokens, literalGlobToken('['))
+				i++
+				continue
+			}
+
+			class := pattern[i+1 : i+1+closing]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			tokens = append(tokens, globToken{match: func(ch byte) bool {
+				return matchClass(class, ch) != negate
+			}})
+			i += 2 + closing
+		default:
+			tokens = append(tokens, literalGlobToken(pattern[i]))
+			i++
+		}
+	}
+	return tokens
+}
+
+func literalGlobToken(b byte) globToken {
+	return globToken{match: func(ch byte) bool { return ch == b }}
+}
+
+// globMatch reports whether s matches pattern, which may use '*' (any run
+// of characters), '?' (any single character), and '[...]' character
+// classes (optionally negated with a leading '^', and supporting 'a-z'
+// ranges) -- the subset of glob syntax PSUBSCRIBE patterns use.
+//
+// It's a two-pointer scan over the parsed tokens that, on a mismatch,
+// backtracks only to the most recent '*' rather than recursively retrying
+// every split point after it, so it runs in O(len(pattern)*len(s)) instead
+// of blowing up exponentially on adversarial patterns like
+// strings.Repeat("*a", 30).
+func globMatch(pattern, s string) bool {
+	tokens := parseGlobPattern(pattern)
+
+	si, ti := 0, 0
+	starTi, starSi := -1, 0
+	for si < len(s) {
+		switch {
+		case ti < len(tokens) && !tokens[ti].star && tokens[ti].match(s[si]):
+			si++
+			ti++
+		case ti < len(tokens) && tokens[ti].star:
+			starTi, starSi = ti, si
+			ti++
+		case starTi != -1:
+			starSi++
+			si = starSi
+			ti = starTi + 1
+		default:
+			return false
+		}
+	}
+
+	for ti < len(tokens) && tokens[ti].star {
+		ti++
+	}
+	return ti == len(tokens)
+}
+
+func matchClass(class string, ch byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if ch >= lo && ch <= hi {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// Server owns the listener and everything needed to run and stop it
+// cleanly: the registry of live clients, a WaitGroup tracking their
+// handler goroutines, a bounded pool of accept tokens, and the pub/sub
+// registry shared by every connection.
+type Server struct {
+	listener        net.Listener
+	store           *Store
+	pubsub          *PubSub
+	wg              sync.WaitGroup
+	done            chan struct{}
+	tokens          chan struct{}
+	shutdownTimeout time.Duration
+
+	nextID    uint64
+	clientsMu sync.Mutex
+	clients   map[string]*client
+}
+
+func NewServer(listener net.Listener, store *Store, maxClients int, shutdownTimeout time.Duration) *Server {
+	return &Server{
+		listener:        listener,
+		store:           store,
+		pubsub:          NewPubSub(),
+		done:            make(chan struct{}),
+		tokens:          make(chan struct{}, maxClients),
+		shutdownTimeout: shutdownTimeout,
+		clients:         make(map[string]*client),
+	}
+}
+
+// Serve accepts connections until Shutdown closes srv.done, bounding how
+// many run concurrently by acquiring a token before each Accept and
+// returning it once the connection's handler exits.
+func (srv *Server) Serve() {
+	for {
+		select {
+		case srv.tokens <- struct{}{}:
+		case <-srv.done:
+			return
+		}
+
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			<-srv.tokens
+			select {
+			case <-srv.done:
+				return
+			default:
+				fmt.Println(err)
+				return
+			}
+		}
+
+		srv.wg.Add(1)
+		go srv.handleConnection(conn)
+	}
+}
+
+func (srv *Server) register(conn net.Conn) *client {
+	id := strconv.FormatUint(atomic.AddUint64(&srv.nextID, 1), 10)
+	c := newClient(id, conn)
+
+	srv.clientsMu.Lock()
+	srv.clients[id] = c
+	srv.clientsMu.Unlock()
+
+	return c
+}
+
+func (srv *Server) unregister(c *client) {
+	srv.clientsMu.Lock()
+	delete(srv.clients, c.id)
+	srv.clientsMu.Unlock()
+
+	srv.pubsub.UnsubscribeAll(c)
+	close(c.outbox)
+}
+
+func (srv *Server) handleConnection(conn net.Conn) {
+	defer srv.wg.Done()
+	defer func() { <-srv.tokens }()
+
+	c := srv.register(conn)
+	defer srv.unregister(c)
+
+	fmt.Printf("Serving %s (id=%s)\n", conn.RemoteAddr(), c.id)
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		cmd, err := readCommand(reader)
+		if err != nil {
+			fmt.Println("error reading:", err)
+			break
+		}
+
+		if !runCommand(srv, c, cmd) {
+			break
+		}
+	}
+
+	fmt.Println("Closing client", c.id)
+	conn.Close()
+}
+
+// Shutdown stops accepting new connections, unblocks every registered
+// client's pending read, and waits up to shutdownTimeout for their
+// handler goroutines to exit before returning.
+func (srv *Server) Shutdown() {
+	close(srv.done)
+	srv.listener.Close()
+
+	srv.clientsMu.Lock()
+	for _, c := range srv.clients {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	srv.clientsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(srv.shutdownTimeout):
+		fmt.Println("shutdown timed out waiting for clients to disconnect")
+	}
+}
+
+// subscribeModeAllowed are the commands a client may still issue once it
+// has at least one channel or pattern subscription.
+var subscribeModeAllowed = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"STOP":         true,
+}
+
+// handler implements one command. It returns the reply to send (empty if
+// it already sent its own replies directly, as SUBSCRIBE does) and false
+// when the connection should be closed after it runs.
+type handler func(srv *Server, c *client, args []string) (string, bool)
+
+var handlers = map[string]handler{
+	"STOP":         handleQuit,
+	"QUIT":         handleQuit,
+	"GET":          handleGet,
+	"SET":          handleSet,
+	"INCR":         handleIncr,
+	"DEL":          handleDel,
+	"EXPIRE":       handleExpire,
+	"PEXPIRE":      handlePExpire,
+	"TTL":          handleTTL,
+	"PERSIST":      handlePersist,
+	"ECHO":         handleEcho,
+	"BGREWRITEAOF": handleBgRewriteAOF,
+	"CLIENT":       handleClient,
+	"PING":         handlePing,
+	"SUBSCRIBE":    handleSubscribe,
+	"UNSUBSCRIBE":  handleUnsubscribe,
+	"PSUBSCRIBE":   handlePSubscribe,
+	"PUNSUBSCRIBE": handlePUnsubscribe,
+	"PUBLISH":      handlePublish,
+}
+
+// aof is the append-only log used to persist write commands. It is nil
+// when the server was started without -appendonly.
+var aof *AOF
+
+func handleQuit(srv *Server, c *client, args []string) (string, bool) {
+	return "", false
+}
+
+func handleGet(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 1 {
+		return errorReply("ERR wrong number of arguments for 'get' command"), true
+	}
+
+	value, ok := srv.store.Get(args[0])
+	if !ok {
+		return nullBulkStringReply(), true
+	}
+	return bulkStringReply(value), true
+}
+
+// handleSet implements SET key value [EX seconds|PX ms] [NX|XX].
+func handleSet(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) < 2 {
+		return errorReply("ERR wrong number of arguments for 'set' command"), true
+	}
+
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return errorReply("ERR syntax error"), true
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				return errorReply("ERR value is not an integer or out of range"), true
+			}
+			if strings.ToUpper(args[i]) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return errorReply("ERR syntax error"), true
+		}
+	}
+
+	exists := srv.store.Exists(key)
+	if nx && exists {
+		return nullBulkStringReply(), true
+	}
+	if xx && !exists {
+		return nullBulkStringReply(), true
+	}
+
+	srv.store.SetExpire(key, value, ttl)
+	return simpleStringReply("OK"), true
+}
+
+func handleIncr(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 1 {
+		return errorReply("ERR wrong number of arguments for 'incr' command"), true
+	}
+
+	n, err := srv.store.Incr(args[0])
+	if err != nil {
+		return errorReply(err.Error()), true
+	}
+	return integerReply(n), true
+}
+
+func handleDel(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 1 {
+		return errorReply("ERR wrong number of arguments for 'del' command"), true
+	}
+
+	if srv.store.Del(args[0]) {
+		return integerReply(1), true
+	}
+	return integerReply(0), true
+}
+
+func handleExpire(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 2 {
+		return errorReply("ERR wrong number of arguments for 'expire' command"), true
+	}
+
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errorReply("ERR value is not an integer or out of range"), true
+	}
+
+	if srv.store.Expire(args[0], time.Duration(seconds)*time.Second) {
+		return integerReply(1), true
+	}
+	return integerReply(0), true
+}
+
+func handlePExpire(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 2 {
+		return errorReply("ERR wrong number of arguments for 'pexpire' command"), true
+	}
+
+	millis, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errorReply("ERR value is not an integer or out of range"), true
+	}
+
+	if srv.store.Expire(args[0], time.Duration(millis)*time.Millisecond) {
+		return integerReply(1), true
+	}
+	return integerReply(0), true
+}
+
+func handleTTL(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 1 {
+		return errorReply("ERR wrong number of arguments for 'ttl' command"), true
+	}
+
+	return integerReply(srv.store.TTL(args[0])), true
+}
+
+func handlePersist(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 1 {
+		return errorReply("ERR wrong number of arguments for 'persist' command"), true
+	}
+
+	if srv.store.Persist(args[0]) {
+		return integerReply(1), true
+	}
+	return integerReply(0), true
+}
+
+func handleEcho(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 1 {
+		return errorReply("ERR wrong number of arguments for 'echo' command"), true
+	}
+
+	return bulkStringReply(args[0]), true
+}
+
+func handlePing(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) == 0 {
+		return simpleStringReply("PONG"), true
+	}
+	return bulkStringReply(args[0]), true
+}
+
+func handleBgRewriteAOF(srv *Server, c *client, args []string) (string, bool) {
+	if aof == nil {
+		return errorReply("ERR appendonly is disabled"), true
+	}
+
+	if err := aof.Rewrite(srv.store); err != nil {
+		return errorReply("ERR " + err.Error()), true
+	}
+
+	return simpleStringReply("Background append only file rewriting started"), true
+}
+
+// handleClient implements CLIENT LIST, which lists every registered
+// connection, and CLIENT KILL <id>, which forcibly closes one.
+func handleClient(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) == 0 {
+		return errorReply("ERR wrong number of arguments for 'client' command"), true
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LIST":
+		srv.clientsMu.Lock()
+		var b strings.Builder
+		for _, other := range srv.clients {
+			fmt.Fprintf(&b, "id=%s addr=%s\n", other.id, other.conn.RemoteAddr())
+		}
+		srv.clientsMu.Unlock()
+		return bulkStringReply(b.String()), true
+	case "KILL":
+		if len(args) != 2 {
+			return errorReply("ERR wrong number of arguments for 'client|kill' command"), true
+		}
+
+		srv.clientsMu.Lock()
+		target, ok := srv.clients[args[1]]
+		srv.clientsMu.Unlock()
+
+		if !ok {
+			return errorReply("ERR No such client ID"), true
+		}
+		target.conn.Close()
+		return simpleStringReply("OK"), true
+	default:
+		return errorReply(fmt.Sprintf("ERR unknown CLIENT subcommand '%s'", args[0])), true
+	}
+}
+
+func handleSubscribe(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) == 0 {
+		return errorReply("ERR wrong number of arguments for 'subscribe' command"), true
+	}
+
+	for _, channel := range args {
+		c.channels[channel] = true
+		srv.pubsub.Subscribe(channel, c)
+		c.send(encodeMessage("subscribe", channel, strconv.Itoa(c.subscriptionCount())))
+	}
+	return "", true
+}
+
+func handlePSubscribe(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) == 0 {
+		return errorReply("ERR wrong number of arguments for 'psubscribe' command"), true
+	}
+
+	for _, pattern := range args {
+		c.patterns[pattern] = true
+		srv.pubsub.PSubscribe(pattern, c)
+		c.send(encodeMessage("psubscribe", pattern, strconv.Itoa(c.subscriptionCount())))
+	}
+	return "", true
+}
+
+func handleUnsubscribe(srv *Server, c *client, args []string) (string, bool) {
+	channels := args
+	if len(channels) == 0 {
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+	}
+
+	for _, channel := range channels {
+		delete(c.channels, channel)
+		srv.pubsub.Unsubscribe(channel, c)
+		c.send(encodeMessage("unsubscribe", channel, strconv.Itoa(c.subscriptionCount())))
+	}
+	return "", true
+}
+
+func handlePUnsubscribe(srv *Server, c *client, args []string) (string, bool) {
+	patterns := args
+	if len(patterns) == 0 {
+		for pattern := range c.patterns {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	for _, pattern := range patterns {
+		delete(c.patterns, pattern)
+		srv.pubsub.PUnsubscribe(pattern, c)
+		c.send(encodeMessage("punsubscribe", pattern, strconv.Itoa(c.subscriptionCount())))
+	}
+	return "", true
+}
+
+func handlePublish(srv *Server, c *client, args []string) (string, bool) {
+	if len(args) != 2 {
+		return errorReply("ERR wrong number of arguments for 'publish' command"), true
+	}
+
+	return integerReply(srv.pubsub.Publish(args[0], args[1])), true
+}
+
+// runCommand dispatches cmd to its handler and enqueues the reply on c's
+// outbox. It returns false when the connection should be closed.
+func runCommand(srv *Server, c *client, cmd command) bool {
+	if c.subscribed() && !subscribeModeAllowed[cmd.name] {
+		c.send(errorReply(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(cmd.name))))
+		return true
+	}
+
+	h, ok := handlers[cmd.name]
+	if !ok {
+		c.send(errorReply(fmt.Sprintf("ERR unknown command '%s'", cmd.name)))
+		return true
+	}
+
+	reply, more := h(srv, c, cmd.args)
+	if reply != "" {
+		c.send(reply)
+	}
+
+	if aof != nil && writeCommands[cmd.name] {
+		if err := aof.Append(cmd); err != nil {
+			fmt.Println("error appending to AOF:", err)
+		}
+	}
+
+	return more
+}
+
+const activeExpirationInterval = 100 * time.Millisecond
+const activeExpirationSampleSize = 20
+const defaultShutdownTimeout = 5 * time.Second
+
+func main() {
+	appendonlyPath := flag.String("appendonly", "", "path to the append-only file; empty disables persistence")
+	appendfsync := flag.String("appendfsync", string(AOFSyncNo), "fsync policy: always, everysec, or no")
+	maxClients := flag.Int("maxclients", 128, "maximum number of concurrently connected clients")
+	shutdownTimeout := flag.Duration("shutdowntimeout", defaultShutdownTimeout, "how long to wait for clients to disconnect on shutdown")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Println("Please provide a port number!")
+		return
+	}
+
+	store := NewStore()
+
+	if *appendonlyPath != "" {
+		// Replay before the live append handle exists: runCommand only
+		// appends to the AOF when the package-level aof is non-nil, so
+		// replaying first keeps it nil and stops replayed writes from
+		// being re-logged onto the file they were just read from.
+		if err := replayAOF(*appendonlyPath, store); err != nil {
+			fmt.Println("error replaying append-only file:", err)
+			return
+		}
+
+		var err error
+		aof, err = OpenAOF(*appendonlyPath, AOFSyncPolicy(*appendfsync))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	PORT := ":" + args[0]
+	listener, err := net.Listen("tcp4", PORT)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	expirationDone := make(chan struct{})
+	store.startActiveExpiration(expirationDone, activeExpirationInterval, activeExpirationSampleSize)
+	defer close(expirationDone)
+
+	srv := NewServer(listener, store, *maxClients, *shutdownTimeout)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	serveDone := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(serveDone)
+	}()
+
+	// Block on whichever happens first: Serve returning on its own, or a
+	// signal arriving. On a signal, Shutdown runs synchronously here so
+	// main doesn't return - and the process doesn't exit - until it has
+	// actually finished waiting for clients to disconnect.
+	select {
+	case <-serveDone:
+	case <-sigCh:
+		fmt.Println("shutting down...")
+		srv.Shutdown()
+		<-serveDone
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redis-load pipelines a RESP dump file over TCP into a running instance,
+// the same way rsload-style loader tools do: the whole file is written to
+// the connection back to back, then a final ECHO <nonce> is sent and the
+// tool waits for that exact reply so the caller knows every command in
+// the dump was acknowledged before exiting.
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Println("Usage: redis-load <dump-file> <host:port>")
+		os.Exit(1)
+	}
+
+	dumpPath, addr := os.Args[1], os.Args[2]
+
+	dump, err := os.Open(dumpPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer dump.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	if _, err := io.Copy(conn, dump); err != nil {
+		fmt.Println("error pipelining dump:", err)
+		os.Exit(1)
+	}
+
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 10)
+	echo := fmt.Sprintf("*2\r\n$4\r\nECHO\r\n$%d\r\n%s\r\n", len(nonce), nonce)
+	if _, err := conn.Write([]byte(echo)); err != nil {
+		fmt.Println("error sending sentinel:", err)
+		os.Exit(1)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println("error waiting for sentinel reply:", err)
+			os.Exit(1)
+		}
+
+		if strings.TrimSpace(line) == nonce {
+			break
+		}
+	}
+
+	fmt.Println("load complete, every command was acknowledged")
+}
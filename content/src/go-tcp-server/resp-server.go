@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// db is the shared key/value store, same map used by stateful-server.go.
+var db = make(map[string]string)
+
+// command is a single parsed client request: a name and the arguments that
+// follow it.
+type command struct {
+	name string
+	args []string
+}
+
+// readCommand reads one request from r. It accepts RESP arrays of bulk
+// strings, the format redis-cli and loader tools speak, as well as the
+// plain space-separated inline commands a telnet client would send.
+func readCommand(r *bufio.Reader) (command, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return command{}, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "*") {
+		return readArrayCommand(r, line)
+	}
+
+	return readInlineCommand(line)
+}
+
+func readInlineCommand(line string) (command, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return command{}, fmt.Errorf("ERR empty command")
+	}
+
+	return command{name: strings.ToUpper(parts[0]), args: parts[1:]}, nil
+}
+
+func readArrayCommand(r *bufio.Reader, firstLine string) (command, error) {
+	count, err := strconv.Atoi(firstLine[1:])
+	if err != nil || count <= 0 {
+		return command{}, fmt.Errorf("ERR Protocol error: invalid multibulk length")
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		arg, err := readBulkString(r)
+		if err != nil {
+			return command{}, err
+		}
+		args = append(args, arg)
+	}
+
+	return command{name: strings.ToUpper(args[0]), args: args[1:]}, nil
+}
+
+// maxBulkLen caps the length a client (or a replayed AOF/dump file) can
+// claim for a single bulk string, mirroring real Redis's 512MB proto-max-
+// bulk-len so a bogus length can't force an arbitrarily large allocation.
+const maxBulkLen = 512 * 1024 * 1024
+
+// readBulkString reads a single `$len\r\n<bytes>\r\n` frame. It is
+// length-prefixed rather than line based so binary-safe values, including
+// ones containing '\n', survive the round trip.
+func readBulkString(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if !strings.HasPrefix(line, "$") {
+		return "", fmt.Errorf("ERR Protocol error: expected '$', got '%s'", line)
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return "", fmt.Errorf("ERR Protocol error: invalid bulk length")
+	}
+	if length > maxBulkLen {
+		return "", fmt.Errorf("ERR Protocol error: invalid bulk length")
+	}
+
+	buf := make([]byte, length+2) // +2 for the trailing \r\n
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf[:length]), nil
+}
+
+func writeSimpleString(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func writeInteger(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func writeBulkString(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeNullBulkString(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+// handler implements one command. It writes the reply to w and returns
+// false when the connection should be closed after it runs.
+type handler func(w *bufio.Writer, args []string) bool
+
+var handlers = map[string]handler{
+	"STOP": handleQuit,
+	"QUIT": handleQuit,
+	"GET":  handleGet,
+	"SET":  handleSet,
+	"INCR": handleIncr,
+	"DEL":  handleDel,
+}
+
+func handleQuit(w *bufio.Writer, args []string) bool {
+	return false
+}
+
+func handleGet(w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'get' command")
+		return true
+	}
+
+	value, ok := db[args[0]]
+	if !ok {
+		writeNullBulkString(w)
+		return true
+	}
+	writeBulkString(w, value)
+	return true
+}
+
+func handleSet(w *bufio.Writer, args []string) bool {
+	if len(args) != 2 {
+		writeError(w, "ERR wrong number of arguments for 'set' command")
+		return true
+	}
+
+	db[args[0]] = args[1]
+	writeSimpleString(w, "OK")
+	return true
+}
+
+func handleIncr(w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'incr' command")
+		return true
+	}
+
+	key := args[0]
+	intValue := 0
+	if value, ok := db[key]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return true
+		}
+		intValue = parsed
+	}
+
+	intValue++
+	db[key] = strconv.Itoa(intValue)
+	writeInteger(w, intValue)
+	return true
+}
+
+func handleDel(w *bufio.Writer, args []string) bool {
+	if len(args) != 1 {
+		writeError(w, "ERR wrong number of arguments for 'del' command")
+		return true
+	}
+
+	if _, ok := db[args[0]]; ok {
+		delete(db, args[0])
+		writeInteger(w, 1)
+	} else {
+		writeInteger(w, 0)
+	}
+	return true
+}
+
+func handleConnection(client net.Conn) {
+	fmt.Printf("Serving %s\n", client.RemoteAddr().String())
+
+	reader := bufio.NewReader(client)
+	writer := bufio.NewWriter(client)
+
+	for {
+		cmd, err := readCommand(reader)
+		if err != nil {
+			fmt.Println("error reading:", err)
+			break
+		}
+
+		if !runCommand(writer, cmd) {
+			break
+		}
+
+		writer.Flush()
+	}
+
+	fmt.Println("Closing client")
+	client.Close()
+}
+
+// runCommand dispatches cmd to its handler and writes the reply to w. It
+// returns false when the connection should be closed.
+func runCommand(w *bufio.Writer, cmd command) bool {
+	h, ok := handlers[cmd.name]
+	if !ok {
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", cmd.name))
+		return true
+	}
+
+	return h(w, cmd.args)
+}
+
+func main() {
+	arguments := os.Args
+	if len(arguments) == 1 {
+		fmt.Println("Please provide a port number!")
+		return
+	}
+
+	PORT := ":" + arguments[1]
+	server, err := net.Listen("tcp4", PORT)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer server.Close()
+
+	for {
+		client, err := server.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go handleConnection(client)
+	}
+}
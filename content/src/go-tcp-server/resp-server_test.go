@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// loadRESPDump opens path, dials addr, and pipes the dump over the
+// connection exactly as the rsload-style loader tool does, returning
+// everything the server wrote back.
+func loadRESPDump(t *testing.T, addr, path string) string {
+	t.Helper()
+
+	dump, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open dump: %v", err)
+	}
+	defer dump.Close()
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.Copy(conn, dump); err != nil {
+		t.Fatalf("pipe dump: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+
+	return string(reply)
+}
+
+func TestLoadRESPDumpOverTCP(t *testing.T) {
+	db = make(map[string]string)
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		handleConnection(client)
+	}()
+
+	dump := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$4\r\nQUIT\r\n"
+
+	path := t.TempDir() + "/dump.resp"
+	if err := os.WriteFile(path, []byte(dump), 0o644); err != nil {
+		t.Fatalf("write dump: %v", err)
+	}
+
+	reply := loadRESPDump(t, listener.Addr().String(), path)
+
+	want := "+OK\r\n" + "$3\r\nbar\r\n" + "$-1\r\n" + ":1\r\n"
+	if reply != want {
+		t.Fatalf("reply = %q, want %q", reply, want)
+	}
+}
+
+func TestReadCommandArray(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+
+	cmd, err := readCommand(r)
+	if err != nil {
+		t.Fatalf("readCommand: %v", err)
+	}
+	if cmd.name != "GET" || len(cmd.args) != 1 || cmd.args[0] != "foo" {
+		t.Fatalf("got %+v", cmd)
+	}
+}
+
+func TestReadCommandInline(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("GET foo\r\n"))
+
+	cmd, err := readCommand(r)
+	if err != nil {
+		t.Fatalf("readCommand: %v", err)
+	}
+	if cmd.name != "GET" || len(cmd.args) != 1 || cmd.args[0] != "foo" {
+		t.Fatalf("got %+v", cmd)
+	}
+}
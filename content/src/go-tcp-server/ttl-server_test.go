@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRunActiveExpirationCycle(t *testing.T) {
+	var fakeNow time.Time
+	store := NewStore()
+	store.now = func() time.Time { return fakeNow }
+
+	fakeNow = time.Unix(1000, 0)
+	store.SetExpire("expired1", "a", time.Second)
+	store.SetExpire("expired2", "b", time.Second)
+	store.Set("live1", "c")
+	store.SetExpire("live2", "d", time.Hour)
+
+	fakeNow = fakeNow.Add(2 * time.Second)
+
+	sampled, expired := store.runActiveExpirationCycle(10)
+	if sampled != 4 {
+		t.Fatalf("sampled = %d, want 4", sampled)
+	}
+	if expired != 2 {
+		t.Fatalf("expired = %d, want 2", expired)
+	}
+
+	if store.Exists("expired1") || store.Exists("expired2") {
+		t.Fatalf("expired keys were not purged")
+	}
+	if !store.Exists("live1") || !store.Exists("live2") {
+		t.Fatalf("live keys were incorrectly purged")
+	}
+}
+
+// TestActiveExpirationResamplesWithinATick mirrors the loop startActiveExpiration
+// runs on every tick: keep sampling until a round comes back at or under 25%
+// expired, so a burst of expired keys doesn't linger across ticks.
+func TestActiveExpirationResamplesWithinATick(t *testing.T) {
+	var fakeNow time.Time
+	store := NewStore()
+	store.now = func() time.Time { return fakeNow }
+
+	fakeNow = time.Unix(2000, 0)
+	for i := 0; i < 8; i++ {
+		store.SetExpire(fmt.Sprintf("k%d", i), "v", time.Second)
+	}
+	fakeNow = fakeNow.Add(2 * time.Second)
+
+	rounds := 0
+	for {
+		sampled, expired := store.runActiveExpirationCycle(4)
+		rounds++
+		if sampled == 0 || float64(expired)/float64(sampled) <= 0.25 {
+			break
+		}
+	}
+
+	if rounds < 2 {
+		t.Fatalf("expected the sampler to resample within the tick, got %d round(s)", rounds)
+	}
+	for i := 0; i < 8; i++ {
+		if store.Exists(fmt.Sprintf("k%d", i)) {
+			t.Fatalf("k%d should have been purged by active expiration", i)
+		}
+	}
+}